@@ -1,12 +1,11 @@
 package martian
 
 import (
-  "bytes"
-  "encoding/base64"
   "encoding/json"
   "fmt"
-  "io/ioutil"
+  "mime"
   "net/http"
+  "strconv"
   "strings"
 
   "github.com/google/martian/parse"
@@ -26,23 +25,41 @@ type pathPosModifierEntry struct {
   KeyJWT   string `json:"keyJWT"`
 }
 
+// headerModifierEntry is a Header rewrite target: it sets request header Name to the JWT claim named by KeyJWT,
+// or, with Append set, adds it as an extra value instead of replacing the header.
+type headerModifierEntry struct {
+  Name   string `json:"name"`
+  KeyJWT string `json:"keyJWT"`
+  Append bool   `json:"append"`
+}
+
 type jwt map[string]interface{}
 
-// FromJWT implements martian.RequestModifier interface. It writes value from JWT to the request's query, path and
-// body (only JSON body is supported).
+// FromJWT implements martian.RequestModifier interface. It writes value from JWT to the request's query, path,
+// header and body (only JSON body is supported).
 // A path can be updated in following ways: 'PathString' entry replaces substring (in path) defined in
 // modifierEntry.Name by specified value from JWT; 'PathParam' rewrites path parameter on position defined in
 // pathPosModifierEntry.Position by specified value from JWT. Position of some substring in the url means position
 // in url split by character "/" indexed from 0. So e.g. substring "{var1}" in url "/some/{var1}/path/{var2}" has
 // position 1, substring "{var2}" has position 3 etc.
+//
+// Required lists claim names that must be present and non-empty, independent of whether they are mapped to any
+// target above; ClaimTypes maps a claim name (as used in any entry's KeyJWT) to the Go type it must decode to -
+// "string", "number", "bool" or "stringArray" - so a mismatch fails the request instead of silently rendering e.g.
+// an array as "[a b c]".
+//
+// See jwtSource for how the JWT itself is located and verified.
 type FromJWT struct {
-  Querystring  []modifierEntry        `json:"querystring"`
-  PathString   []modifierEntry        `json:"path_string"`
-  PathParam    []pathPosModifierEntry `json:"path_param"`
-  JsonBody     []modifierEntry        `json:"json_body"`
-  Scope        []parse.ModifierType   `json:"scope"`
-  JwtCookieKey string                 `json:"jwt_cookie_key"`
-  jwt          jwt
+  jwtSource
+
+  Querystring []modifierEntry        `json:"querystring"`
+  PathString  []modifierEntry        `json:"path_string"`
+  PathParam   []pathPosModifierEntry `json:"path_param"`
+  JsonBody    []modifierEntry        `json:"json_body"`
+  Header      []headerModifierEntry  `json:"header"`
+  Required    []string               `json:"required"`
+  ClaimTypes  map[string]string      `json:"claim_types"`
+  Scope       []parse.ModifierType   `json:"scope"`
 }
 
 // NewModifier creates new FromJWT object (constructor).
@@ -56,6 +73,10 @@ func (self *FromJWT) ModifyRequest(req *http.Request) error {
   if err != nil {
     return err
   }
+  // enforce required-claim policy before touching the request
+  if err := self.checkRequiredClaims(jwt); err != nil {
+    return err
+  }
   // modify query params
   if err := self.modifyQuerystring(req, jwt); err != nil {
     return err
@@ -72,6 +93,10 @@ func (self *FromJWT) ModifyRequest(req *http.Request) error {
   if err := self.modifyBodyJson(req, jwt); err != nil {
     return err
   }
+  // modify headers
+  if err := self.modifyHeaders(req, jwt); err != nil {
+    return err
+  }
   // results
   //fmt.Printf("req.URL: %v\n", req.URL.String())
   //fmt.Printf("req.Body: %v\n", req.Body)
@@ -84,42 +109,10 @@ func modifierFromJSON(b []byte) (*parse.Result, error) {
   if err := json.Unmarshal(b, &modifier); err != nil {
     return nil, err
   }
-  return parse.NewResult(&modifier, modifier.Scope)
-}
-
-// parseJwtValues parses JWT included in request. A JWT is parsed primary from "Authorization" header. The JWT
-// is parsed from Cookie (with name defined in FromJWT.JwtCookieKey) if it's not found in the auth header.
-// The function fails if JWT is not present in auth header, nor cookie.
-func (self *FromJWT) parseJwtValues(req *http.Request) (jwt, error) {
-  var jwtData jwt
-  raw := ""
-  if h := req.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[0:7], "BEARER ") {
-    raw = h[7:]
-  }
-  if raw == "" {
-    cookie, err := req.Cookie(self.JwtCookieKey)
-    if err != nil {
-      return nil, err
-    }
-    raw = cookie.Value
-  }
-  if raw == "" {
-    return nil, fmt.Errorf("jwt not found in auth header, nor cookie")
-  }
-
-  // split token into 3 parts and decode payload
-  jwtParts := strings.Split(raw, ".")
-  if len(jwtParts) < 3 {
-    return nil, fmt.Errorf("bad format of jwt")
-  }
-  b, err := base64.RawURLEncoding.DecodeString(jwtParts[1])
-  if err != nil {
+  if err := modifier.init(); err != nil {
     return nil, err
   }
-  if err := json.Unmarshal(b, &jwtData); err != nil {
-    return nil, err
-  }
-  return jwtData, nil
+  return parse.NewResult(&modifier, modifier.Scope)
 }
 
 // replaceVarInUrl replaces some substring on specified position by specified value. Position of some substring in
@@ -155,17 +148,16 @@ func (self *FromJWT) replaceVarInUrl(url string, varPosition int, newValue strin
 }
 
 // modifyQuerystring rewrites values of specified querystring parameters by specified values from JWT. If specified
-// querystring parameter not exists, a new one is created.
+// querystring parameter not exists, a new one is created. An array claim is written as repeated querystring
+// values (?key=a&key=b&key=c) rather than Go's slice formatting.
 func (self *FromJWT) modifyQuerystring(req *http.Request, jwt jwt) error {
   query := req.URL.Query()
   for _, entry := range self.Querystring {
-    newVal, ok := jwt[entry.KeyJWT]
-    if !ok {
-      return fmt.Errorf("key=%s not in jwt", entry.KeyJWT)
+    newVal, err := self.claimValue(jwt, entry.KeyJWT)
+    if err != nil {
+      return err
     }
-    query.Set(entry.Name, fmt.Sprintf("%v", newVal))
-    // if there are more parameters with same name (e.g. ?key1=10&key1=20&key1=30), query.Set rewrites this array by
-    // one value; so if we want to preserve array of values, we should use query.Set & query.Add (for each query value)
+    query[entry.Name] = claimValueStrings(newVal)
   }
   req.URL.RawQuery = query.Encode()
   return nil
@@ -174,11 +166,11 @@ func (self *FromJWT) modifyQuerystring(req *http.Request, jwt jwt) error {
 // modifyPathParams rewrites path parameter on defined position by specified value from JWT.
 func (self *FromJWT) modifyPathParams(req *http.Request, jwt jwt) error {
   for _, entry := range self.PathParam {
-    newVal, ok := jwt[entry.KeyJWT]
-    if !ok {
-      return fmt.Errorf("key=%s not in jwt", entry.KeyJWT)
+    newVal, err := self.claimValue(jwt, entry.KeyJWT)
+    if err != nil {
+      return err
     }
-    req.URL.Path = self.replaceVarInUrl(req.URL.Path, entry.Position, fmt.Sprintf("%v", newVal))
+    req.URL.Path = self.replaceVarInUrl(req.URL.Path, entry.Position, formatClaimValue(newVal))
   }
   return nil
 }
@@ -186,43 +178,165 @@ func (self *FromJWT) modifyPathParams(req *http.Request, jwt jwt) error {
 // modifyPathStrings replaces specified substring (in path) by specified value from JWT.
 func (self *FromJWT) modifyPathStrings(req *http.Request, jwt jwt) error {
   for _, entry := range self.PathString {
-    newVal, ok := jwt[entry.KeyJWT]
-    if !ok {
-      return fmt.Errorf("key=%s not in jwt", entry.KeyJWT)
+    newVal, err := self.claimValue(jwt, entry.KeyJWT)
+    if err != nil {
+      return err
     }
-    req.URL.Path = strings.ReplaceAll(req.URL.Path, entry.Name, fmt.Sprintf("%v", newVal))
+    req.URL.Path = strings.ReplaceAll(req.URL.Path, entry.Name, formatClaimValue(newVal))
   }
   return nil
 }
 
-// modifyPathStrings rewrites specified key in a json body by specified value from JWT. Nested fields (json paths) and
-// json arrays are not supported for now.
+// modifyBodyJson rewrites keys in a JSON body by values from the JWT. entry.Name may be a flat top-level key, an
+// RFC 6901 JSON Pointer ("/user/profile/id", "/items/0/owner") or a dotted path with array indices
+// ("user.profile.id", "items[0].owner"); intermediate objects are created as needed. entry.KeyJWT may likewise be
+// a JSON Pointer into the claims (e.g. "/realm_access/roles/0") to reach a nested claim. The body is decoded into
+// an order-preserving representation so unrelated keys keep their original position.
 func (self *FromJWT) modifyBodyJson(req *http.Request, jwt jwt) error {
-  if req.Body == nil || len(self.JsonBody) == 0 || req.Header.Get("Content-type") != "application/json" {
+  if req.Body == nil || len(self.JsonBody) == 0 || !isJsonContentType(req.Header) {
     return nil
   }
-  bodyBytes, err := ioutil.ReadAll(req.Body)
+  for _, entry := range self.JsonBody {
+    if _, err := self.claimValue(jwt, entry.KeyJWT); err != nil {
+      return err
+    }
+  }
+  newBody, newLen, err := rewriteJsonBody(req.Body, self.JsonBody, jwt)
   if err != nil {
     return err
   }
-  req.Body.Close()
+  req.Body = newBody
+  req.ContentLength = newLen
+  if req.Header.Get("Content-Length") != "" {
+    req.Header.Set("Content-Length", strconv.FormatInt(newLen, 10))
+  }
+  return nil
+}
 
-  bodyData := make(map[string]interface{})
-  if err := json.Unmarshal(bodyBytes, &bodyData); err != nil {
-    return err
+// modifyHeaders sets (or, for entries with Append, adds) request headers to values from the JWT, same array
+// handling as modifyQuerystring.
+func (self *FromJWT) modifyHeaders(req *http.Request, jwt jwt) error {
+  for _, entry := range self.Header {
+    newVal, err := self.claimValue(jwt, entry.KeyJWT)
+    if err != nil {
+      return err
+    }
+    if !entry.Append {
+      req.Header.Del(entry.Name)
+    }
+    for _, v := range claimValueStrings(newVal) {
+      req.Header.Add(entry.Name, v)
+    }
   }
+  return nil
+}
 
-  for _, entry := range self.JsonBody {
-    newVal, ok := jwt[entry.KeyJWT]
+// claimValue looks up claim key in jwt - a flat top-level claim name or an RFC 6901 JSON Pointer, same as
+// entry.KeyJWT elsewhere - and, if ClaimTypes configures an expected type for it, verifies the claim actually has
+// that type before returning it.
+func (self *FromJWT) claimValue(jwt jwt, key string) (interface{}, error) {
+  val, ok := lookupJwtValue(jwt, key)
+  if !ok {
+    return nil, fmt.Errorf("key=%s not in jwt", key)
+  }
+  if wantType, ok := self.ClaimTypes[key]; ok {
+    if err := checkClaimType(key, wantType, val); err != nil {
+      return nil, err
+    }
+  }
+  return val, nil
+}
+
+// checkClaimType reports an error if val's JSON-decoded type doesn't match wantType: "string", "number", "bool"
+// or "stringArray" (a JSON array of strings).
+func checkClaimType(key, wantType string, val interface{}) error {
+  switch wantType {
+  case "string":
+    if _, ok := val.(string); !ok {
+      return fmt.Errorf("claim %q: expected type string, got %T", key, val)
+    }
+  case "number":
+    if _, ok := val.(float64); !ok {
+      return fmt.Errorf("claim %q: expected type number, got %T", key, val)
+    }
+  case "bool":
+    if _, ok := val.(bool); !ok {
+      return fmt.Errorf("claim %q: expected type bool, got %T", key, val)
+    }
+  case "stringArray":
+    arr, ok := val.([]interface{})
     if !ok {
-      return fmt.Errorf("key=%s not in jwt", entry.KeyJWT)
+      return fmt.Errorf("claim %q: expected type stringArray, got %T", key, val)
+    }
+    for _, elem := range arr {
+      if _, ok := elem.(string); !ok {
+        return fmt.Errorf("claim %q: expected type stringArray, got element of type %T", key, elem)
+      }
     }
-    bodyData[entry.Name] = newVal
+  default:
+    return fmt.Errorf("claim %q: unknown claim type %q", key, wantType)
   }
-  newBodyBytes, err := json.Marshal(bodyData)
-  if err != nil {
-    return err
+  return nil
+}
+
+// checkRequiredClaims fails with a clear error if any claim named in Required is missing or empty, independent of
+// whether it is mapped to any rewrite target.
+func (self *FromJWT) checkRequiredClaims(jwt jwt) error {
+  for _, name := range self.Required {
+    val, ok := lookupJwtValue(jwt, name)
+    if !ok || claimIsEmpty(val) {
+      return fmt.Errorf("required claim %q missing", name)
+    }
   }
-  req.Body = ioutil.NopCloser(bytes.NewBuffer(newBodyBytes))
   return nil
 }
+
+// claimIsEmpty reports whether a claim value should be treated as absent by Required: nil, an empty string or an
+// empty array.
+func claimIsEmpty(val interface{}) bool {
+  switch v := val.(type) {
+  case nil:
+    return true
+  case string:
+    return v == ""
+  case []interface{}:
+    return len(v) == 0
+  default:
+    return false
+  }
+}
+
+// claimValueStrings renders a JWT claim value as the values it should be written with: a single string for any
+// scalar claim, or one string per element for an array claim (rather than Go's slice formatting, e.g. "[a b c]").
+func claimValueStrings(val interface{}) []string {
+  arr, ok := val.([]interface{})
+  if !ok {
+    return []string{fmt.Sprintf("%v", val)}
+  }
+  values := make([]string, len(arr))
+  for i, elem := range arr {
+    values[i] = fmt.Sprintf("%v", elem)
+  }
+  return values
+}
+
+// formatClaimValue renders a JWT claim value as a single string for targets, like a path segment, that can only
+// hold one value: scalars render as-is, array claims join their elements with "," (rather than Go's slice
+// formatting, e.g. "[a b c]").
+func formatClaimValue(val interface{}) string {
+  return strings.Join(claimValueStrings(val), ",")
+}
+
+// isJsonContentType reports whether header's Content-Type is application/json, ignoring case and any parameters
+// such as "; charset=utf-8".
+func isJsonContentType(header http.Header) bool {
+  ct := header.Get("Content-Type")
+  if ct == "" {
+    return false
+  }
+  mediaType, _, err := mime.ParseMediaType(ct)
+  if err != nil {
+    mediaType = ct
+  }
+  return strings.EqualFold(strings.TrimSpace(mediaType), "application/json")
+}
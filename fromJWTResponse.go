@@ -0,0 +1,101 @@
+package martian
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+
+  "github.com/google/martian/parse"
+)
+
+func init() {
+  parse.Register("fromJWT.ResponseModifier", responseModifierFromJSON)
+}
+
+// FromJWTResponse implements martian.ResponseModifier. It is the mirror image of FromJWT: instead of reading
+// values out of the upstream request, it projects claims from the caller's JWT into the upstream's response,
+// letting operators enrich a backend's JSON body (or response headers) with identity data without a code change
+// to the backend.
+//
+// The JWT is located and verified using the same jwtSource machinery as FromJWT, re-extracted from
+// res.Request (the original request as sent upstream) - FromJWTResponse does not depend on a FromJWT instance
+// having run first, so it can be used on its own.
+type FromJWTResponse struct {
+  jwtSource
+
+  JsonBody       []modifierEntry      `json:"json_body"`
+  ResponseHeader []modifierEntry      `json:"response_header"`
+  Scope          []parse.ModifierType `json:"scope"`
+}
+
+// NewResponseModifier creates new FromJWTResponse object (constructor).
+func NewResponseModifier() *FromJWTResponse {
+  return &FromJWTResponse{}
+}
+
+// ModifyResponse modifies response.
+func (self *FromJWTResponse) ModifyResponse(res *http.Response) error {
+  if res.Request == nil {
+    return fmt.Errorf("fromJWT: response has no associated request")
+  }
+  jwt, err := self.parseJwtValues(res.Request)
+  if err != nil {
+    return err
+  }
+  // inject claims into response headers
+  if err := self.modifyResponseHeader(res, jwt); err != nil {
+    return err
+  }
+  // inject claims into json body (replace some keys)
+  if err := self.modifyResponseBodyJson(res, jwt); err != nil {
+    return err
+  }
+  return nil
+}
+
+// responseModifierFromJSON creates a response modifier from JSON data.
+func responseModifierFromJSON(b []byte) (*parse.Result, error) {
+  modifier := FromJWTResponse{}
+  if err := json.Unmarshal(b, &modifier); err != nil {
+    return nil, err
+  }
+  if err := modifier.init(); err != nil {
+    return nil, err
+  }
+  return parse.NewResult(&modifier, modifier.Scope)
+}
+
+// modifyResponseHeader sets response headers to values from the JWT. An array claim is written as multiple
+// header values (via Del + Add), same as FromJWT.modifyHeaders, rather than Go's slice formatting.
+func (self *FromJWTResponse) modifyResponseHeader(res *http.Response, jwt jwt) error {
+  for _, entry := range self.ResponseHeader {
+    newVal, ok := lookupJwtValue(jwt, entry.KeyJWT)
+    if !ok {
+      return fmt.Errorf("key=%s not in jwt", entry.KeyJWT)
+    }
+    res.Header.Del(entry.Name)
+    for _, v := range claimValueStrings(newVal) {
+      res.Header.Add(entry.Name, v)
+    }
+  }
+  return nil
+}
+
+// modifyResponseBodyJson rewrites keys in the response's JSON body by values from the JWT, using the same path
+// syntax (JSON Pointer or dotted path) as FromJWT.JsonBody.
+func (self *FromJWTResponse) modifyResponseBodyJson(res *http.Response, jwt jwt) error {
+  if res.Body == nil || len(self.JsonBody) == 0 || !isJsonContentType(res.Header) {
+    return nil
+  }
+  newBody, newLen, err := rewriteJsonBody(res.Body, self.JsonBody, jwt)
+  if err != nil {
+    return err
+  }
+  res.Body = newBody
+  res.ContentLength = newLen
+  if res.Header.Get("Content-Length") != "" {
+    res.Header.Set("Content-Length", strconv.FormatInt(newLen, 10))
+  }
+  return nil
+}
@@ -0,0 +1,102 @@
+package martian
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+func insecureJwtRequest(t *testing.T, claims map[string]interface{}) *http.Request {
+  t.Helper()
+  header := map[string]interface{}{"alg": "none", "typ": "JWT"}
+  encode := func(v interface{}) string {
+    b, err := json.Marshal(v)
+    if err != nil {
+      t.Fatalf("marshal: %v", err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+  }
+  token := encode(header) + "." + encode(claims) + "."
+  req := httptest.NewRequest("GET", "/", nil)
+  req.Header.Set("Authorization", "Bearer "+token)
+  return req
+}
+
+func TestFromJWTResponseModifyResponseHeader(t *testing.T) {
+  m := FromJWTResponse{
+    jwtSource:      jwtSource{Insecure: true},
+    ResponseHeader: []modifierEntry{{Name: "X-User-Id", KeyJWT: "sub"}},
+  }
+  if err := m.init(); err != nil {
+    t.Fatalf("init: %v", err)
+  }
+  req := insecureJwtRequest(t, map[string]interface{}{"sub": "user-1"})
+  res := &http.Response{Request: req, Header: make(http.Header)}
+
+  if err := m.ModifyResponse(res); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if got := res.Header.Get("X-User-Id"); got != "user-1" {
+    t.Errorf("unexpected header, got %q", got)
+  }
+}
+
+func TestFromJWTResponseModifyResponseHeaderArrayClaim(t *testing.T) {
+  m := FromJWTResponse{
+    jwtSource:      jwtSource{Insecure: true},
+    ResponseHeader: []modifierEntry{{Name: "X-Role", KeyJWT: "roles"}},
+  }
+  if err := m.init(); err != nil {
+    t.Fatalf("init: %v", err)
+  }
+  req := insecureJwtRequest(t, map[string]interface{}{"roles": []interface{}{"admin", "user"}})
+  res := &http.Response{Request: req, Header: make(http.Header)}
+
+  if err := m.ModifyResponse(res); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  expected := []string{"admin", "user"}
+  if got := res.Header.Values("X-Role"); strings.Join(got, ",") != strings.Join(expected, ",") {
+    t.Errorf("unexpected X-Role, got %v, expected %v", got, expected)
+  }
+}
+
+func TestFromJWTResponseModifyResponseBodyJson(t *testing.T) {
+  m := FromJWTResponse{
+    jwtSource: jwtSource{Insecure: true},
+    JsonBody:  []modifierEntry{{Name: "owner", KeyJWT: "sub"}},
+  }
+  if err := m.init(); err != nil {
+    t.Fatalf("init: %v", err)
+  }
+  req := insecureJwtRequest(t, map[string]interface{}{"sub": "user-1"})
+  res := &http.Response{
+    Request:       req,
+    Header:        http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{"8"}},
+    Body:          ioutil.NopCloser(strings.NewReader(`{"id":1}`)),
+    ContentLength: 8,
+  }
+
+  if err := m.ModifyResponse(res); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    t.Fatalf("read body: %v", err)
+  }
+  expected := `{"id":1,"owner":"user-1"}`
+  if string(body) != expected {
+    t.Errorf("unexpected body, got %s, expected %s", body, expected)
+  }
+  if res.ContentLength != int64(len(expected)) {
+    t.Errorf("unexpected ContentLength, got %d, expected %d", res.ContentLength, len(expected))
+  }
+  if got := res.Header.Get("Content-Length"); got != strconv.Itoa(len(expected)) {
+    t.Errorf("unexpected Content-Length header, got %q, expected %q", got, strconv.Itoa(len(expected)))
+  }
+}
@@ -1,9 +1,67 @@
 package martian
 
 import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "io/ioutil"
+  "net/http/httptest"
+  "strconv"
+  "strings"
   "testing"
 )
 
+func signHS256(t *testing.T, secret string, header, payload map[string]interface{}) string {
+  t.Helper()
+  encode := func(v interface{}) string {
+    b, err := json.Marshal(v)
+    if err != nil {
+      t.Fatalf("marshal: %v", err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+  }
+  signingInput := encode(header) + "." + encode(payload)
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write([]byte(signingInput))
+  return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyJwtHmac(t *testing.T) {
+  m := FromJWT{jwtSource: jwtSource{HmacSecret: "s3cr3t"}}
+  header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+  payload := map[string]interface{}{"sub": "user-1"}
+  token := signHS256(t, "s3cr3t", header, payload)
+
+  claims, err := m.verifyJwt(strings.Split(token, "."))
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if claims["sub"] != "user-1" {
+    t.Errorf("unexpected sub claim: %v", claims["sub"])
+  }
+
+  tampered := signHS256(t, "wrong-secret", header, payload)
+  if _, err := m.verifyJwt(strings.Split(tampered, ".")); err == nil {
+    t.Errorf("expected bad-signature error, got nil")
+  } else if jwtErr, ok := err.(*JWTError); !ok || jwtErr.Kind != JWTErrBadSignature {
+    t.Errorf("expected JWTErrBadSignature, got %v", err)
+  }
+}
+
+func TestVerifyJwtRejectsNoneAlgorithm(t *testing.T) {
+  m := FromJWT{}
+  header := map[string]interface{}{"alg": "none", "typ": "JWT"}
+  payload := map[string]interface{}{"sub": "user-1"}
+  token := signHS256(t, "", header, payload)
+
+  if _, err := m.verifyJwt(strings.Split(token, ".")); err == nil {
+    t.Errorf("expected bad-alg error, got nil")
+  } else if jwtErr, ok := err.(*JWTError); !ok || jwtErr.Kind != JWTErrBadAlgorithm {
+    t.Errorf("expected JWTErrBadAlgorithm, got %v", err)
+  }
+}
+
 func TestReplaceVarInUrl(t *testing.T) {
   var m FromJWT
   expectedUrl := "/v1/files/2/specs/{specID}/"
@@ -27,3 +85,104 @@ func TestReplaceVarInUrl(t *testing.T) {
     t.Errorf("unexpected url, got %v, expeced: %v", url, expectedUrl)
   }
 }
+
+func TestCheckRequiredClaims(t *testing.T) {
+  m := FromJWT{Required: []string{"sub", "/realm_access/roles"}}
+  claims := jwt{"sub": "user-1", "realm_access": map[string]interface{}{"roles": []interface{}{"admin"}}}
+  if err := m.checkRequiredClaims(claims); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+
+  missing := jwt{"sub": ""}
+  if err := m.checkRequiredClaims(missing); err == nil {
+    t.Errorf("expected error for missing/empty required claims, got nil")
+  }
+}
+
+func TestClaimValueChecksClaimTypes(t *testing.T) {
+  m := FromJWT{ClaimTypes: map[string]string{"roles": "stringArray", "age": "number"}}
+  claims := jwt{"roles": []interface{}{"admin", "user"}, "age": "not-a-number"}
+
+  if _, err := m.claimValue(claims, "roles"); err != nil {
+    t.Errorf("unexpected error for matching type: %v", err)
+  }
+  if _, err := m.claimValue(claims, "age"); err == nil {
+    t.Errorf("expected type mismatch error, got nil")
+  }
+}
+
+func TestModifyHeadersAppend(t *testing.T) {
+  m := FromJWT{Header: []headerModifierEntry{
+    {Name: "X-Tenant-Id", KeyJWT: "tenant"},
+    {Name: "X-Role", KeyJWT: "roles", Append: true},
+  }}
+  claims := jwt{"tenant": "acme", "roles": []interface{}{"admin", "user"}}
+  req := httptest.NewRequest("GET", "/", nil)
+  req.Header.Set("X-Role", "existing")
+
+  if err := m.modifyHeaders(req, claims); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if got := req.Header.Get("X-Tenant-Id"); got != "acme" {
+    t.Errorf("unexpected X-Tenant-Id, got %v", got)
+  }
+  expectedRoles := []string{"existing", "admin", "user"}
+  if got := req.Header.Values("X-Role"); strings.Join(got, ",") != strings.Join(expectedRoles, ",") {
+    t.Errorf("unexpected X-Role, got %v, expected %v", got, expectedRoles)
+  }
+}
+
+func TestModifyPathParamsArrayClaim(t *testing.T) {
+  m := FromJWT{PathParam: []pathPosModifierEntry{{Position: 1, KeyJWT: "roles"}}}
+  claims := jwt{"roles": []interface{}{"admin", "user"}}
+  req := httptest.NewRequest("GET", "/some/{roles}/path", nil)
+
+  if err := m.modifyPathParams(req, claims); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  expected := "/some/admin,user/path"
+  if req.URL.Path != expected {
+    t.Errorf("unexpected path, got %q, expected %q", req.URL.Path, expected)
+  }
+}
+
+func TestModifyQuerystringArrayClaim(t *testing.T) {
+  m := FromJWT{Querystring: []modifierEntry{{Name: "roles", KeyJWT: "roles"}}}
+  claims := jwt{"roles": []interface{}{"admin", "user"}}
+  req := httptest.NewRequest("GET", "/", nil)
+
+  if err := m.modifyQuerystring(req, claims); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  expected := "roles=admin&roles=user"
+  if req.URL.RawQuery != expected {
+    t.Errorf("unexpected query, got %q, expected %q", req.URL.RawQuery, expected)
+  }
+}
+
+func TestModifyBodyJsonUpdatesContentLength(t *testing.T) {
+  m := FromJWT{JsonBody: []modifierEntry{{Name: "owner", KeyJWT: "sub"}}}
+  claims := jwt{"sub": "a-very-long-user-id-value-123456789"}
+  req := httptest.NewRequest("POST", "/", strings.NewReader(`{"id":1}`))
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("Content-Length", "8")
+  req.ContentLength = 8
+
+  if err := m.modifyBodyJson(req, claims); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    t.Fatalf("read body: %v", err)
+  }
+  expected := `{"id":1,"owner":"a-very-long-user-id-value-123456789"}`
+  if string(body) != expected {
+    t.Errorf("unexpected body, got %s, expected %s", body, expected)
+  }
+  if req.ContentLength != int64(len(expected)) {
+    t.Errorf("unexpected ContentLength, got %d, expected %d", req.ContentLength, len(expected))
+  }
+  if got := req.Header.Get("Content-Length"); got != strconv.Itoa(len(expected)) {
+    t.Errorf("unexpected Content-Length header, got %q, expected %q", got, strconv.Itoa(len(expected)))
+  }
+}
@@ -0,0 +1,346 @@
+package martian
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// orderedMap is a JSON object that remembers the order its keys were first seen in, so
+// marshalling it back out preserves the original body's key ordering (callers like signature
+// verification or log diffing rely on a stable, canonical byte representation).
+type orderedMap struct {
+  keys   []string
+  values map[string]interface{}
+}
+
+func newOrderedMap() *orderedMap {
+  return &orderedMap{values: make(map[string]interface{})}
+}
+
+// Get returns the value stored under key, if any.
+func (self *orderedMap) Get(key string) (interface{}, bool) {
+  v, ok := self.values[key]
+  return v, ok
+}
+
+// Set stores value under key, appending key to the key order the first time it is seen.
+func (self *orderedMap) Set(key string, value interface{}) {
+  if _, ok := self.values[key]; !ok {
+    self.keys = append(self.keys, key)
+  }
+  self.values[key] = value
+}
+
+// UnmarshalJSON decodes a JSON object while recording key order; nested objects decode to
+// *orderedMap too, nested arrays to []interface{}.
+func (self *orderedMap) UnmarshalJSON(data []byte) error {
+  dec := json.NewDecoder(bytes.NewReader(data))
+  dec.UseNumber()
+  value, err := decodeOrderedJSON(dec)
+  if err != nil {
+    return err
+  }
+  om, ok := value.(*orderedMap)
+  if !ok {
+    return fmt.Errorf("expected a json object at the top level, got %T", value)
+  }
+  *self = *om
+  return nil
+}
+
+// MarshalJSON encodes the object back to JSON, in key-insertion order.
+func (self *orderedMap) MarshalJSON() ([]byte, error) {
+  var buf bytes.Buffer
+  buf.WriteByte('{')
+  for i, key := range self.keys {
+    if i > 0 {
+      buf.WriteByte(',')
+    }
+    keyBytes, err := json.Marshal(key)
+    if err != nil {
+      return nil, err
+    }
+    buf.Write(keyBytes)
+    buf.WriteByte(':')
+    valBytes, err := json.Marshal(self.values[key])
+    if err != nil {
+      return nil, err
+    }
+    buf.Write(valBytes)
+  }
+  buf.WriteByte('}')
+  return buf.Bytes(), nil
+}
+
+// decodeOrderedJSON reads the next JSON value off dec, decoding objects as *orderedMap and
+// arrays as []interface{} (recursively), and everything else as its natural Go type.
+func decodeOrderedJSON(dec *json.Decoder) (interface{}, error) {
+  tok, err := dec.Token()
+  if err != nil {
+    return nil, err
+  }
+  delim, isDelim := tok.(json.Delim)
+  if !isDelim {
+    return tok, nil
+  }
+  switch delim {
+  case '{':
+    m := newOrderedMap()
+    for dec.More() {
+      keyTok, err := dec.Token()
+      if err != nil {
+        return nil, err
+      }
+      key, ok := keyTok.(string)
+      if !ok {
+        return nil, fmt.Errorf("expected string object key, got %v", keyTok)
+      }
+      value, err := decodeOrderedJSON(dec)
+      if err != nil {
+        return nil, err
+      }
+      m.Set(key, value)
+    }
+    if _, err := dec.Token(); err != nil { // consume '}'
+      return nil, err
+    }
+    return m, nil
+  case '[':
+    arr := []interface{}{}
+    for dec.More() {
+      value, err := decodeOrderedJSON(dec)
+      if err != nil {
+        return nil, err
+      }
+      arr = append(arr, value)
+    }
+    if _, err := dec.Token(); err != nil { // consume ']'
+      return nil, err
+    }
+    return arr, nil
+  default:
+    return nil, fmt.Errorf("unexpected json delimiter %q", delim)
+  }
+}
+
+// jsonPathSegment is one step of a parsed json body path: either an object key (field) or,
+// when isIndex is true, a position inside an array.
+type jsonPathSegment struct {
+  field   string
+  isIndex bool
+  index   int
+}
+
+var jsonPointerArrayIndex = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+
+// parseJsonPath parses name as an RFC 6901 JSON Pointer ("/user/profile/id", "/items/0/owner")
+// when it starts with "/", or as a dotted path with optional array indices otherwise
+// ("user.profile.id", "items[0].owner").
+func parseJsonPath(name string) ([]jsonPathSegment, error) {
+  if strings.HasPrefix(name, "/") {
+    return parseJsonPointer(name)
+  }
+  return parseDottedPath(name)
+}
+
+// parseJsonPointer parses a single RFC 6901 pointer into segments, unescaping "~1" to "/" and
+// "~0" to "~". Purely-numeric tokens are also marked as array indices, since a pointer alone
+// can't say whether it targets an object or an array; that's resolved against the actual data
+// while walking the path.
+func parseJsonPointer(pointer string) ([]jsonPathSegment, error) {
+  tokens := strings.Split(pointer[1:], "/")
+  replacer := strings.NewReplacer("~1", "/", "~0", "~")
+  segments := make([]jsonPathSegment, 0, len(tokens))
+  for _, tok := range tokens {
+    tok = replacer.Replace(tok)
+    seg := jsonPathSegment{field: tok}
+    if jsonPointerArrayIndex.MatchString(tok) {
+      seg.isIndex = true
+      seg.index, _ = strconv.Atoi(tok)
+    }
+    segments = append(segments, seg)
+  }
+  return segments, nil
+}
+
+// parseDottedPath parses a dotted path such as "items[0].owner" into segments: "items[0]"
+// becomes a field segment ("items") followed by an index segment (0).
+func parseDottedPath(path string) ([]jsonPathSegment, error) {
+  if path == "" {
+    return nil, fmt.Errorf("empty json body path")
+  }
+  var segments []jsonPathSegment
+  for _, part := range strings.Split(path, ".") {
+    name := part
+    for {
+      open := strings.IndexByte(name, '[')
+      if open == -1 {
+        break
+      }
+      close := strings.IndexByte(name, ']')
+      if close == -1 || close < open {
+        return nil, fmt.Errorf("invalid json body path %q: unbalanced brackets", path)
+      }
+      if open > 0 {
+        segments = append(segments, jsonPathSegment{field: name[:open]})
+      }
+      index, err := strconv.Atoi(name[open+1 : close])
+      if err != nil || index < 0 {
+        return nil, fmt.Errorf("invalid json body path %q: bad array index %q", path, name[open+1:close])
+      }
+      segments = append(segments, jsonPathSegment{field: name[open+1 : close], isIndex: true, index: index})
+      name = name[close+1:]
+    }
+    if name != "" {
+      segments = append(segments, jsonPathSegment{field: name})
+    }
+  }
+  if len(segments) == 0 {
+    return nil, fmt.Errorf("invalid json body path %q", path)
+  }
+  return segments, nil
+}
+
+// setJsonBodyPath writes value at the location described by path within root, creating
+// intermediate objects (and growing arrays with nil padding) as needed.
+func setJsonBodyPath(root *orderedMap, path string, value interface{}) error {
+  segments, err := parseJsonPath(path)
+  if err != nil {
+    return err
+  }
+  updated, err := applyJsonPath(root, segments, value)
+  if err != nil {
+    return fmt.Errorf("json body path %q: %v", path, err)
+  }
+  newRoot, ok := updated.(*orderedMap)
+  if !ok {
+    return fmt.Errorf("json body path %q must resolve to a field of the top-level object", path)
+  }
+  *root = *newRoot
+  return nil
+}
+
+// applyJsonPath writes value at segments within container (an *orderedMap, a []interface{}, or
+// nil for "doesn't exist yet"), returning the (possibly newly created) container.
+func applyJsonPath(container interface{}, segments []jsonPathSegment, value interface{}) (interface{}, error) {
+  seg := segments[0]
+  rest := segments[1:]
+
+  // a numeric token applied to an existing object names one of its fields
+  if _, isObj := container.(*orderedMap); isObj {
+    seg.isIndex = false
+  }
+  if seg.isIndex {
+    arr, ok := container.([]interface{})
+    if !ok {
+      if container != nil {
+        return nil, fmt.Errorf("expected an array to index %d into, got %T", seg.index, container)
+      }
+      arr = []interface{}{}
+    }
+    for len(arr) <= seg.index {
+      arr = append(arr, nil)
+    }
+    if len(rest) == 0 {
+      arr[seg.index] = value
+      return arr, nil
+    }
+    child, err := applyJsonPath(arr[seg.index], rest, value)
+    if err != nil {
+      return nil, err
+    }
+    arr[seg.index] = child
+    return arr, nil
+  }
+
+  m, ok := container.(*orderedMap)
+  if !ok {
+    if container != nil {
+      return nil, fmt.Errorf("expected an object to set field %q on, got %T", seg.field, container)
+    }
+    m = newOrderedMap()
+  }
+  if len(rest) == 0 {
+    m.Set(seg.field, value)
+    return m, nil
+  }
+  existing, _ := m.Get(seg.field)
+  child, err := applyJsonPath(existing, rest, value)
+  if err != nil {
+    return nil, err
+  }
+  m.Set(seg.field, child)
+  return m, nil
+}
+
+// lookupJwtValue reads a claim from jwt. key is treated as an RFC 6901 JSON Pointer into the
+// claims when it starts with "/" (e.g. "/realm_access/roles/0"), and as a flat top-level claim
+// name otherwise, same as before.
+func lookupJwtValue(claims jwt, key string) (interface{}, bool) {
+  if !strings.HasPrefix(key, "/") {
+    v, ok := claims[key]
+    return v, ok
+  }
+  segments, err := parseJsonPointer(key)
+  if err != nil {
+    return nil, false
+  }
+  var cur interface{} = map[string]interface{}(claims)
+  for _, seg := range segments {
+    switch c := cur.(type) {
+    case map[string]interface{}:
+      v, ok := c[seg.field]
+      if !ok {
+        return nil, false
+      }
+      cur = v
+    case []interface{}:
+      if !seg.isIndex || seg.index >= len(c) {
+        return nil, false
+      }
+      cur = c[seg.index]
+    default:
+      return nil, false
+    }
+  }
+  return cur, true
+}
+
+// rewriteJsonBody decodes body as a JSON object, writes each entry's JWT claim (entry.KeyJWT) at the body path
+// entry.Name (see setJsonBodyPath and lookupJwtValue for the accepted path syntax), and returns the re-encoded
+// body along with its length. body is closed; the returned ReadCloser replaces it. Callers must update
+// ContentLength (and any Content-Length header) to the returned length, since a rewrite routinely changes the
+// body size.
+func rewriteJsonBody(body io.ReadCloser, entries []modifierEntry, claims jwt) (io.ReadCloser, int64, error) {
+  bodyBytes, err := ioutil.ReadAll(body)
+  if err != nil {
+    return nil, 0, err
+  }
+  body.Close()
+
+  bodyData := newOrderedMap()
+  if err := json.Unmarshal(bodyBytes, bodyData); err != nil {
+    return nil, 0, err
+  }
+
+  for _, entry := range entries {
+    newVal, ok := lookupJwtValue(claims, entry.KeyJWT)
+    if !ok {
+      return nil, 0, fmt.Errorf("key=%s not in jwt", entry.KeyJWT)
+    }
+    if err := setJsonBodyPath(bodyData, entry.Name, newVal); err != nil {
+      return nil, 0, err
+    }
+  }
+  newBodyBytes, err := json.Marshal(bodyData)
+  if err != nil {
+    return nil, 0, err
+  }
+  return ioutil.NopCloser(bytes.NewBuffer(newBodyBytes)), int64(len(newBodyBytes)), nil
+}
@@ -0,0 +1,71 @@
+package martian
+
+import (
+  "encoding/json"
+  "testing"
+)
+
+func TestSetJsonBodyPathNested(t *testing.T) {
+  bodyData := newOrderedMap()
+  if err := json.Unmarshal([]byte(`{"user":{"name":"alice"},"other":1}`), bodyData); err != nil {
+    t.Fatalf("unmarshal: %v", err)
+  }
+  if err := setJsonBodyPath(bodyData, "/user/profile/id", "u-123"); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  out, err := json.Marshal(bodyData)
+  if err != nil {
+    t.Fatalf("marshal: %v", err)
+  }
+  expected := `{"user":{"name":"alice","profile":{"id":"u-123"}},"other":1}`
+  if string(out) != expected {
+    t.Errorf("unexpected body, got %s, expected %s", out, expected)
+  }
+}
+
+func TestSetJsonBodyPathArrayIndex(t *testing.T) {
+  bodyData := newOrderedMap()
+  if err := json.Unmarshal([]byte(`{"items":[{"id":1}]}`), bodyData); err != nil {
+    t.Fatalf("unmarshal: %v", err)
+  }
+  if err := setJsonBodyPath(bodyData, "items[0].owner", "bob"); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  out, err := json.Marshal(bodyData)
+  if err != nil {
+    t.Fatalf("marshal: %v", err)
+  }
+  expected := `{"items":[{"id":1,"owner":"bob"}]}`
+  if string(out) != expected {
+    t.Errorf("unexpected body, got %s, expected %s", out, expected)
+  }
+}
+
+func TestSetJsonBodyPathPreservesKeyOrder(t *testing.T) {
+  bodyData := newOrderedMap()
+  if err := json.Unmarshal([]byte(`{"z":1,"a":2,"m":3}`), bodyData); err != nil {
+    t.Fatalf("unmarshal: %v", err)
+  }
+  if err := setJsonBodyPath(bodyData, "a", 99); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  out, err := json.Marshal(bodyData)
+  if err != nil {
+    t.Fatalf("marshal: %v", err)
+  }
+  expected := `{"z":1,"a":99,"m":3}`
+  if string(out) != expected {
+    t.Errorf("unexpected body, got %s, expected %s", out, expected)
+  }
+}
+
+func TestLookupJwtValueJsonPointer(t *testing.T) {
+  claims := jwt{"realm_access": map[string]interface{}{"roles": []interface{}{"admin", "user"}}}
+  v, ok := lookupJwtValue(claims, "/realm_access/roles/0")
+  if !ok || v != "admin" {
+    t.Errorf("unexpected value, got %v, ok=%v", v, ok)
+  }
+  if _, ok := lookupJwtValue(claims, "/realm_access/roles/9"); ok {
+    t.Errorf("expected missing index to fail")
+  }
+}
@@ -0,0 +1,220 @@
+package martian
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rsa"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// defaultJwksCacheTTL is used when a JWKS response carries neither a Cache-Control max-age nor an
+// Expires header.
+const defaultJwksCacheTTL = 5 * time.Minute
+
+// jwksFetchTimeout bounds how long a single JWKS fetch may take, so a slow or unresponsive IdP
+// can't wedge every request sharing this cache.
+const jwksFetchTimeout = 5 * time.Second
+
+// jwksHTTPClient is used for all JWKS fetches; it carries jwksFetchTimeout as an overall
+// request deadline.
+var jwksHTTPClient = &http.Client{Timeout: jwksFetchTimeout}
+
+// jwk represents a single JSON Web Key as served by a JWKS endpoint. Only the fields needed to
+// verify RSA and EC signatures are kept; HS256 tokens are verified against HmacSecret, not a JWK.
+type jwk struct {
+  Kty string `json:"kty"`
+  Kid string `json:"kid"`
+  Crv string `json:"crv"`
+  N   string `json:"n"`
+  E   string `json:"e"`
+  X   string `json:"x"`
+  Y   string `json:"y"`
+}
+
+// jwksDocument is the top-level JSON structure returned by a JWKS endpoint.
+type jwksDocument struct {
+  Keys []jwk `json:"keys"`
+}
+
+// jwksCache fetches and caches the JSON Web Keys served at url, keyed by "kid". The whole key set
+// is refreshed on a cache-miss and whenever the TTL derived from the last response's
+// Cache-Control/Expires headers has elapsed.
+type jwksCache struct {
+  url string
+
+  mu        sync.RWMutex
+  keys      map[string]jwk
+  expiresAt time.Time
+}
+
+// newJwksCache creates a jwksCache for the given JWKS endpoint (constructor).
+func newJwksCache(url string) *jwksCache {
+  return &jwksCache{url: url, keys: make(map[string]jwk)}
+}
+
+// key returns the JWK identified by kid, refreshing the cache first if kid is unknown or the
+// cache has expired.
+func (self *jwksCache) key(kid string) (jwk, error) {
+  if key, ok := self.lookup(kid); ok {
+    return key, nil
+  }
+  if err := self.refresh(); err != nil {
+    return jwk{}, err
+  }
+  if key, ok := self.lookup(kid); ok {
+    return key, nil
+  }
+  return jwk{}, &JWTError{Kind: JWTErrKidNotFound, Message: fmt.Sprintf("kid %q not found in jwks", kid)}
+}
+
+// all returns a snapshot of every cached key, refreshing the cache first if it has expired. It is
+// used when the token carries no usable kid.
+func (self *jwksCache) all() ([]jwk, error) {
+  self.mu.RLock()
+  expired := time.Now().After(self.expiresAt)
+  self.mu.RUnlock()
+  if expired {
+    if err := self.refresh(); err != nil {
+      return nil, err
+    }
+  }
+  self.mu.RLock()
+  defer self.mu.RUnlock()
+  keys := make([]jwk, 0, len(self.keys))
+  for _, k := range self.keys {
+    keys = append(keys, k)
+  }
+  return keys, nil
+}
+
+func (self *jwksCache) lookup(kid string) (jwk, bool) {
+  self.mu.RLock()
+  defer self.mu.RUnlock()
+  if time.Now().After(self.expiresAt) {
+    return jwk{}, false
+  }
+  key, ok := self.keys[kid]
+  return key, ok
+}
+
+// refresh fetches the JWKS document and replaces the cached key set. The HTTP round trip runs
+// without holding self.mu, so a slow JWKS endpoint blocks only the caller that triggered the
+// refresh, not every other request reading the existing cache via lookup/all.
+func (self *jwksCache) refresh() error {
+  resp, err := jwksHTTPClient.Get(self.url)
+  if err != nil {
+    return fmt.Errorf("fetching jwks from %s: %v", self.url, err)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("fetching jwks from %s: unexpected status %d", self.url, resp.StatusCode)
+  }
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return fmt.Errorf("reading jwks response from %s: %v", self.url, err)
+  }
+  var doc jwksDocument
+  if err := json.Unmarshal(body, &doc); err != nil {
+    return fmt.Errorf("parsing jwks response from %s: %v", self.url, err)
+  }
+
+  keys := make(map[string]jwk, len(doc.Keys))
+  for _, k := range doc.Keys {
+    keys[k.Kid] = k
+  }
+  expiresAt := time.Now().Add(jwksCacheTTL(resp.Header))
+
+  self.mu.Lock()
+  self.keys = keys
+  self.expiresAt = expiresAt
+  self.mu.Unlock()
+  return nil
+}
+
+// jwksCacheTTL derives a cache lifetime from the Cache-Control/Expires response headers, falling
+// back to defaultJwksCacheTTL when neither is present or parseable.
+func jwksCacheTTL(header http.Header) time.Duration {
+  if cc := header.Get("Cache-Control"); cc != "" {
+    for _, directive := range strings.Split(cc, ",") {
+      directive = strings.TrimSpace(directive)
+      if strings.HasPrefix(directive, "max-age=") {
+        if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && seconds > 0 {
+          return time.Duration(seconds) * time.Second
+        }
+      }
+    }
+  }
+  if expires := header.Get("Expires"); expires != "" {
+    if t, err := http.ParseTime(expires); err == nil {
+      if ttl := time.Until(t); ttl > 0 {
+        return ttl
+      }
+    }
+  }
+  return defaultJwksCacheTTL
+}
+
+// rsaPublicKey builds a *rsa.PublicKey out of the key's "n"/"e" members.
+func (self jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+  if self.Kty != "RSA" {
+    return nil, fmt.Errorf("jwk kty=%q is not RSA", self.Kty)
+  }
+  n, err := base64.RawURLEncoding.DecodeString(self.N)
+  if err != nil {
+    return nil, fmt.Errorf("decoding jwk n: %v", err)
+  }
+  e, err := base64.RawURLEncoding.DecodeString(self.E)
+  if err != nil {
+    return nil, fmt.Errorf("decoding jwk e: %v", err)
+  }
+  return &rsa.PublicKey{
+    N: new(big.Int).SetBytes(n),
+    E: int(new(big.Int).SetBytes(e).Int64()),
+  }, nil
+}
+
+// ecdsaPublicKey builds a *ecdsa.PublicKey out of the key's "crv"/"x"/"y" members.
+func (self jwk) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+  if self.Kty != "EC" {
+    return nil, fmt.Errorf("jwk kty=%q is not EC", self.Kty)
+  }
+  curve, err := ellipticCurve(self.Crv)
+  if err != nil {
+    return nil, err
+  }
+  x, err := base64.RawURLEncoding.DecodeString(self.X)
+  if err != nil {
+    return nil, fmt.Errorf("decoding jwk x: %v", err)
+  }
+  y, err := base64.RawURLEncoding.DecodeString(self.Y)
+  if err != nil {
+    return nil, fmt.Errorf("decoding jwk y: %v", err)
+  }
+  return &ecdsa.PublicKey{
+    Curve: curve,
+    X:     new(big.Int).SetBytes(x),
+    Y:     new(big.Int).SetBytes(y),
+  }, nil
+}
+
+func ellipticCurve(crv string) (elliptic.Curve, error) {
+  switch crv {
+  case "P-256":
+    return elliptic.P256(), nil
+  case "P-384":
+    return elliptic.P384(), nil
+  case "P-521":
+    return elliptic.P521(), nil
+  default:
+    return nil, fmt.Errorf("unsupported ec curve %q", crv)
+  }
+}
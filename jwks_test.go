@@ -0,0 +1,34 @@
+package martian
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// TestJwksCacheRefreshRespectsTimeout guards against a stalled JWKS endpoint wedging the cache:
+// refresh must return an error within jwksFetchTimeout instead of blocking forever.
+func TestJwksCacheRefreshRespectsTimeout(t *testing.T) {
+  block := make(chan struct{})
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    <-block
+  }))
+  defer func() {
+    close(block)
+    server.Close()
+  }()
+
+  cache := newJwksCache(server.URL)
+  done := make(chan error, 1)
+  go func() { done <- cache.refresh() }()
+
+  select {
+  case err := <-done:
+    if err == nil {
+      t.Errorf("expected timeout error, got nil")
+    }
+  case <-time.After(jwksFetchTimeout + 2*time.Second):
+    t.Fatalf("refresh did not return within jwksFetchTimeout, cache is wedged")
+  }
+}
@@ -0,0 +1,307 @@
+package martian
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/hmac"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/sha512"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "math/big"
+  "sort"
+  "strings"
+  "time"
+)
+
+// JWTErrorKind classifies why a JWT was rejected, so a KrakenD error handler can map it to the
+// appropriate HTTP status code without parsing the error message.
+type JWTErrorKind string
+
+// Failure categories returned by FromJWT's signature and claim verification.
+const (
+  JWTErrBadAlgorithm  JWTErrorKind = "bad-alg"
+  JWTErrKidNotFound   JWTErrorKind = "kid-not-found"
+  JWTErrExpired       JWTErrorKind = "expired"
+  JWTErrBadSignature  JWTErrorKind = "bad-signature"
+  JWTErrWrongIssuer   JWTErrorKind = "wrong-issuer"
+  JWTErrWrongAudience JWTErrorKind = "wrong-audience"
+)
+
+// JWTError is returned by FromJWT whenever a token fails verification.
+type JWTError struct {
+  Kind    JWTErrorKind
+  Message string
+}
+
+func (self *JWTError) Error() string {
+  return self.Message
+}
+
+// defaultAllowedAlgorithms is used when AllowedAlgorithms is not configured.
+var defaultAllowedAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "HS256"}
+
+// jwtHeader is the decoded JOSE header of a JWT.
+type jwtHeader struct {
+  Alg string `json:"alg"`
+  Kid string `json:"kid"`
+}
+
+// verifyJwt verifies the signature and standard time/issuer/audience claims of the JWT in
+// jwtParts (still base64url-encoded header, payload and signature) and returns its decoded
+// claims.
+func (self *jwtSource) verifyJwt(jwtParts []string) (jwt, error) {
+  headerBytes, err := base64.RawURLEncoding.DecodeString(jwtParts[0])
+  if err != nil {
+    return nil, err
+  }
+  var header jwtHeader
+  if err := json.Unmarshal(headerBytes, &header); err != nil {
+    return nil, err
+  }
+  if !self.algorithmAllowed(header.Alg) {
+    return nil, &JWTError{Kind: JWTErrBadAlgorithm, Message: fmt.Sprintf("algorithm %q is not allowed", header.Alg)}
+  }
+
+  signature, err := base64.RawURLEncoding.DecodeString(jwtParts[2])
+  if err != nil {
+    return nil, err
+  }
+  signingInput := jwtParts[0] + "." + jwtParts[1]
+  if err := self.verifySignature(header, signingInput, signature); err != nil {
+    return nil, err
+  }
+
+  payloadBytes, err := base64.RawURLEncoding.DecodeString(jwtParts[1])
+  if err != nil {
+    return nil, err
+  }
+  var claims jwt
+  if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+    return nil, err
+  }
+  if err := self.verifyClaims(claims); err != nil {
+    return nil, err
+  }
+  return claims, nil
+}
+
+// algorithmAllowed reports whether alg may be used to verify a token, per AllowedAlgorithms (or
+// defaultAllowedAlgorithms when it is not set). "none" is always rejected.
+func (self *jwtSource) algorithmAllowed(alg string) bool {
+  if alg == "" || alg == "none" {
+    return false
+  }
+  allowed := self.AllowedAlgorithms
+  if len(allowed) == 0 {
+    allowed = defaultAllowedAlgorithms
+  }
+  for _, a := range allowed {
+    if a == alg {
+      return true
+    }
+  }
+  return false
+}
+
+// verifySignature dispatches to the HMAC, RSA or ECDSA verifier matching header.Alg.
+func (self *jwtSource) verifySignature(header jwtHeader, signingInput string, signature []byte) error {
+  switch header.Alg {
+  case "HS256":
+    return self.verifyHmac(signingInput, signature)
+  case "RS256", "RS384", "RS512":
+    return self.verifyRsa(header, signingInput, signature)
+  case "ES256", "ES384", "ES512":
+    return self.verifyEcdsa(header, signingInput, signature)
+  default:
+    return &JWTError{Kind: JWTErrBadAlgorithm, Message: fmt.Sprintf("algorithm %q is not supported", header.Alg)}
+  }
+}
+
+// verifyHmac verifies an HS256 token against the inline HmacSecret fallback.
+func (self *jwtSource) verifyHmac(signingInput string, signature []byte) error {
+  if self.HmacSecret == "" {
+    return &JWTError{Kind: JWTErrBadSignature, Message: "HS256 token but no hmac_secret configured"}
+  }
+  mac := hmac.New(sha256.New, []byte(self.HmacSecret))
+  mac.Write([]byte(signingInput))
+  if subtle.ConstantTimeCompare(mac.Sum(nil), signature) != 1 {
+    return &JWTError{Kind: JWTErrBadSignature, Message: "hmac signature mismatch"}
+  }
+  return nil
+}
+
+func (self *jwtSource) verifyRsa(header jwtHeader, signingInput string, signature []byte) error {
+  keys, err := self.resolveKeys(header.Kid)
+  if err != nil {
+    return err
+  }
+  hash, hashed := hashSigningInput(header.Alg, signingInput)
+  lastErr := &JWTError{Kind: JWTErrBadSignature, Message: "rsa signature verification failed"}
+  for _, key := range keys {
+    pubKey, err := key.rsaPublicKey()
+    if err != nil {
+      lastErr = &JWTError{Kind: JWTErrBadSignature, Message: err.Error()}
+      continue
+    }
+    if rsa.VerifyPKCS1v15(pubKey, hash, hashed, signature) == nil {
+      return nil
+    }
+  }
+  return lastErr
+}
+
+func (self *jwtSource) verifyEcdsa(header jwtHeader, signingInput string, signature []byte) error {
+  keys, err := self.resolveKeys(header.Kid)
+  if err != nil {
+    return err
+  }
+  _, hashed := hashSigningInput(header.Alg, signingInput)
+  lastErr := &JWTError{Kind: JWTErrBadSignature, Message: "ecdsa signature verification failed"}
+  for _, key := range keys {
+    pubKey, err := key.ecdsaPublicKey()
+    if err != nil {
+      lastErr = &JWTError{Kind: JWTErrBadSignature, Message: err.Error()}
+      continue
+    }
+    size := (pubKey.Curve.Params().BitSize + 7) / 8
+    if len(signature) != 2*size {
+      lastErr = &JWTError{Kind: JWTErrBadSignature, Message: "unexpected ecdsa signature length"}
+      continue
+    }
+    r := new(big.Int).SetBytes(signature[:size])
+    s := new(big.Int).SetBytes(signature[size:])
+    if ecdsa.Verify(pubKey, hashed, r, s) {
+      return nil
+    }
+  }
+  return lastErr
+}
+
+// resolveKeys picks the JWKS entries to try verifying against, most likely candidate first. When KidHeader is
+// set, the token's kid must match a cached key and that is the only candidate returned; otherwise every cached
+// key is a candidate (a key whose kid matches the token's, if any, is tried first), which keeps providers that
+// omit "kid" - or rotate keys without every client having refreshed yet - working: the caller tries each
+// candidate in turn until one verifies.
+func (self *jwtSource) resolveKeys(kid string) ([]jwk, error) {
+  if self.jwksCache == nil {
+    return nil, &JWTError{Kind: JWTErrKidNotFound, Message: "no jwks_url configured"}
+  }
+  if self.KidHeader {
+    if kid == "" {
+      return nil, &JWTError{Kind: JWTErrKidNotFound, Message: "token has no kid header"}
+    }
+    key, err := self.jwksCache.key(kid)
+    if err != nil {
+      return nil, err
+    }
+    return []jwk{key}, nil
+  }
+  keys, err := self.jwksCache.all()
+  if err != nil {
+    return nil, err
+  }
+  if len(keys) == 0 {
+    return nil, &JWTError{Kind: JWTErrKidNotFound, Message: "jwks has no keys"}
+  }
+  // sort for a deterministic trial order; jwksCache.all() returns a map-derived slice whose order
+  // would otherwise vary between calls
+  sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+  if kid == "" {
+    return keys, nil
+  }
+  matching := make([]jwk, 0, len(keys))
+  rest := make([]jwk, 0, len(keys))
+  for _, k := range keys {
+    if k.Kid == kid {
+      matching = append(matching, k)
+    } else {
+      rest = append(rest, k)
+    }
+  }
+  return append(matching, rest...), nil
+}
+
+// hashSigningInput hashes signingInput with the digest implied by an RS*/ES* algorithm name.
+func hashSigningInput(alg, signingInput string) (crypto.Hash, []byte) {
+  switch {
+  case strings.HasSuffix(alg, "384"):
+    sum := sha512.Sum384([]byte(signingInput))
+    return crypto.SHA384, sum[:]
+  case strings.HasSuffix(alg, "512"):
+    sum := sha512.Sum512([]byte(signingInput))
+    return crypto.SHA512, sum[:]
+  default:
+    sum := sha256.Sum256([]byte(signingInput))
+    return crypto.SHA256, sum[:]
+  }
+}
+
+// verifyClaims validates exp/nbf/iat (with LeewaySeconds tolerance) and, if configured, iss/aud.
+func (self *jwtSource) verifyClaims(claims jwt) error {
+  leeway := time.Duration(self.LeewaySeconds) * time.Second
+  now := time.Now()
+
+  if exp, ok := numericClaim(claims, "exp"); ok && now.After(exp.Add(leeway)) {
+    return &JWTError{Kind: JWTErrExpired, Message: "token is expired"}
+  }
+  if nbf, ok := numericClaim(claims, "nbf"); ok && now.Before(nbf.Add(-leeway)) {
+    return &JWTError{Kind: JWTErrExpired, Message: "token not valid yet"}
+  }
+  if iat, ok := numericClaim(claims, "iat"); ok && now.Before(iat.Add(-leeway)) {
+    return &JWTError{Kind: JWTErrExpired, Message: "token issued in the future"}
+  }
+
+  if self.Issuer != "" {
+    iss, _ := claims["iss"].(string)
+    if iss != self.Issuer {
+      return &JWTError{Kind: JWTErrWrongIssuer, Message: fmt.Sprintf("unexpected issuer %q", iss)}
+    }
+  }
+  if len(self.Audience) > 0 && !audienceMatches(claims["aud"], self.Audience) {
+    return &JWTError{Kind: JWTErrWrongAudience, Message: "token audience does not match"}
+  }
+  return nil
+}
+
+func numericClaim(claims jwt, name string) (time.Time, bool) {
+  switch v := claims[name].(type) {
+  case float64:
+    return time.Unix(int64(v), 0), true
+  case json.Number:
+    f, err := v.Float64()
+    if err != nil {
+      return time.Time{}, false
+    }
+    return time.Unix(int64(f), 0), true
+  default:
+    return time.Time{}, false
+  }
+}
+
+// audienceMatches reports whether the JWT's "aud" claim (a string or an array of strings)
+// contains any of the allowed audiences.
+func audienceMatches(aud interface{}, allowed []string) bool {
+  var actual []string
+  switch v := aud.(type) {
+  case string:
+    actual = []string{v}
+  case []interface{}:
+    for _, item := range v {
+      if s, ok := item.(string); ok {
+        actual = append(actual, s)
+      }
+    }
+  }
+  for _, a := range actual {
+    for _, want := range allowed {
+      if a == want {
+        return true
+      }
+    }
+  }
+  return false
+}
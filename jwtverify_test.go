@@ -0,0 +1,165 @@
+package martian
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func b64(b []byte) string {
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+  t.Helper()
+  b, err := json.Marshal(v)
+  if err != nil {
+    t.Fatalf("marshal: %v", err)
+  }
+  return b64(b)
+}
+
+// signRS256 signs header.payload with key and returns the full JWT, omitting the "kid" header
+// entirely when kid == "" so the token exercises the kid-less verification path.
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, payload map[string]interface{}) string {
+  t.Helper()
+  header := map[string]interface{}{"alg": "RS256", "typ": "JWT"}
+  if kid != "" {
+    header["kid"] = kid
+  }
+  signingInput := encodeSegment(t, header) + "." + encodeSegment(t, payload)
+  hashed := sha256.Sum256([]byte(signingInput))
+  sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+  if err != nil {
+    t.Fatalf("sign: %v", err)
+  }
+  return signingInput + "." + b64(sig)
+}
+
+func rsaJwk(kid string, pub *rsa.PublicKey) jwk {
+  return jwk{
+    Kty: "RSA",
+    Kid: kid,
+    N:   b64(pub.N.Bytes()),
+    E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+  }
+}
+
+func jwksServer(t *testing.T, keys ...jwk) *httptest.Server {
+  t.Helper()
+  return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(jwksDocument{Keys: keys})
+  }))
+}
+
+func TestResolveKeysTriesEveryCachedKeyForKidLessToken(t *testing.T) {
+  signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatalf("generate key: %v", err)
+  }
+  otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatalf("generate key: %v", err)
+  }
+
+  srv := jwksServer(t, rsaJwk("kid-a", &otherKey.PublicKey), rsaJwk("kid-b", &signingKey.PublicKey))
+  defer srv.Close()
+
+  m := &FromJWT{jwtSource: jwtSource{JwksURL: srv.URL}}
+  if err := m.init(); err != nil {
+    t.Fatalf("init: %v", err)
+  }
+
+  token := signRS256(t, signingKey, "", map[string]interface{}{"sub": "user-1"})
+  claims, err := m.parseJwtValues(httptestRequestWithBearer(token))
+  if err != nil {
+    t.Fatalf("unexpected error verifying against a multi-key jwks with no kid in the token: %v", err)
+  }
+  if claims["sub"] != "user-1" {
+    t.Errorf("unexpected sub claim: %v", claims["sub"])
+  }
+}
+
+func TestResolveKeysRejectsUnknownSigner(t *testing.T) {
+  signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatalf("generate key: %v", err)
+  }
+  otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatalf("generate key: %v", err)
+  }
+
+  srv := jwksServer(t, rsaJwk("kid-a", &otherKey.PublicKey))
+  defer srv.Close()
+
+  m := &FromJWT{jwtSource: jwtSource{JwksURL: srv.URL}}
+  if err := m.init(); err != nil {
+    t.Fatalf("init: %v", err)
+  }
+
+  token := signRS256(t, signingKey, "", map[string]interface{}{"sub": "user-1"})
+  if _, err := m.parseJwtValues(httptestRequestWithBearer(token)); err == nil {
+    t.Errorf("expected verification to fail when no cached key matches the signer, got nil")
+  }
+}
+
+func TestResolveKeysEcdsaMultiKey(t *testing.T) {
+  signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatalf("generate key: %v", err)
+  }
+  otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatalf("generate key: %v", err)
+  }
+
+  ecJwk := func(kid string, pub *ecdsa.PublicKey) jwk {
+    return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: b64(pub.X.Bytes()), Y: b64(pub.Y.Bytes())}
+  }
+  srv := jwksServer(t, ecJwk("kid-a", &otherKey.PublicKey), ecJwk("kid-b", &signingKey.PublicKey))
+  defer srv.Close()
+
+  m := &FromJWT{jwtSource: jwtSource{JwksURL: srv.URL}}
+  if err := m.init(); err != nil {
+    t.Fatalf("init: %v", err)
+  }
+
+  header := map[string]interface{}{"alg": "ES256", "typ": "JWT"}
+  payload := map[string]interface{}{"sub": "user-1"}
+  signingInput := encodeSegment(t, header) + "." + encodeSegment(t, payload)
+  hashed := sha256.Sum256([]byte(signingInput))
+  r, s, err := ecdsa.Sign(rand.Reader, signingKey, hashed[:])
+  if err != nil {
+    t.Fatalf("sign: %v", err)
+  }
+  size := (signingKey.Curve.Params().BitSize + 7) / 8
+  sig := make([]byte, 2*size)
+  r.FillBytes(sig[:size])
+  s.FillBytes(sig[size:])
+  token := signingInput + "." + b64(sig)
+
+  claims, err := m.parseJwtValues(httptestRequestWithBearer(token))
+  if err != nil {
+    t.Fatalf("unexpected error verifying ecdsa against a multi-key jwks with no kid in the token: %v", err)
+  }
+  if claims["sub"] != "user-1" {
+    t.Errorf("unexpected sub claim: %v", claims["sub"])
+  }
+}
+
+func httptestRequestWithBearer(token string) *http.Request {
+  req := httptest.NewRequest("GET", "/", nil)
+  req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+  return req
+}
@@ -0,0 +1,123 @@
+package martian
+
+import (
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strings"
+)
+
+// tokenExtractor pulls a raw token candidate out of a request. An empty return value means the
+// source didn't carry a token.
+type tokenExtractor func(req *http.Request) string
+
+// defaultTokenLookup is used when TokenLookup is not configured; a legacy JwtCookieKey is appended
+// after it rather than replacing it.
+var defaultTokenLookup = []string{"header:Authorization:Bearer"}
+
+// buildTokenExtractors parses each TokenLookup entry into a tokenExtractor, in the order they
+// should be tried. A legacy JwtCookieKey, if set, is appended as a "cookie:<name>" extractor so
+// existing configs keep working.
+func buildTokenExtractors(lookups []string, legacyCookieKey string) ([]tokenExtractor, error) {
+  specs := lookups
+  if len(specs) == 0 {
+    specs = defaultTokenLookup
+  }
+  if legacyCookieKey != "" {
+    specs = append(append([]string{}, specs...), "cookie:"+legacyCookieKey)
+  }
+
+  extractors := make([]tokenExtractor, 0, len(specs))
+  for _, spec := range specs {
+    extractor, err := parseTokenLookup(spec)
+    if err != nil {
+      return nil, err
+    }
+    extractors = append(extractors, extractor)
+  }
+  return extractors, nil
+}
+
+// parseTokenLookup parses a single TokenLookup entry into a tokenExtractor. Supported forms are
+// "header:<name>[:<scheme>]", "cookie:<name>", "query:<name>" and "form:<name>".
+func parseTokenLookup(spec string) (tokenExtractor, error) {
+  parts := strings.Split(spec, ":")
+  if len(parts) < 2 || parts[1] == "" {
+    return nil, fmt.Errorf("invalid token_lookup entry %q", spec)
+  }
+  source, name := parts[0], parts[1]
+  switch source {
+  case "header":
+    scheme := ""
+    if len(parts) > 2 {
+      scheme = parts[2]
+    }
+    return headerExtractor(name, scheme), nil
+  case "cookie":
+    return cookieExtractor(name), nil
+  case "query":
+    return queryExtractor(name), nil
+  case "form":
+    return formExtractor(name), nil
+  default:
+    return nil, fmt.Errorf("invalid token_lookup entry %q: unknown source %q", spec, source)
+  }
+}
+
+// headerExtractor reads the named header, optionally stripping a "<scheme> " prefix (e.g.
+// "Bearer ") case-insensitively. With no scheme the whole header value is used as-is.
+func headerExtractor(name, scheme string) tokenExtractor {
+  return func(req *http.Request) string {
+    h := req.Header.Get(name)
+    if h == "" || scheme == "" {
+      return h
+    }
+    prefix := scheme + " "
+    if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+      return ""
+    }
+    return h[len(prefix):]
+  }
+}
+
+func cookieExtractor(name string) tokenExtractor {
+  return func(req *http.Request) string {
+    cookie, err := req.Cookie(name)
+    if err != nil {
+      return ""
+    }
+    return cookie.Value
+  }
+}
+
+func queryExtractor(name string) tokenExtractor {
+  return func(req *http.Request) string {
+    return req.URL.Query().Get(name)
+  }
+}
+
+// formExtractor reads name from the request body, parsed as a URL-encoded form, only; it does not
+// check the request method or Content-Type. Unlike req.FormValue, it
+// does not fall back to the URL query string, so "form:" and "query:" remain distinct token
+// sources. Unlike req.ParseForm, it does not consume req.Body: the body is read once, parsed
+// from a copy, and restored so later modifiers and the proxied request still see it.
+func formExtractor(name string) tokenExtractor {
+  return func(req *http.Request) string {
+    if req.Body == nil {
+      return ""
+    }
+    bodyBytes, err := ioutil.ReadAll(req.Body)
+    req.Body.Close()
+    req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+    if err != nil {
+      return ""
+    }
+    values, err := url.ParseQuery(string(bodyBytes))
+    if err != nil {
+      return ""
+    }
+    return values.Get(name)
+  }
+}
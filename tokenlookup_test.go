@@ -0,0 +1,116 @@
+package martian
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+func TestBuildTokenExtractorsFallsBackToBearerHeader(t *testing.T) {
+  extractors, err := buildTokenExtractors(nil, "")
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  req := &http.Request{Header: http.Header{"Authorization": []string{"Bearer abc.def.ghi"}}}
+  if got := extractors[0](req); got != "abc.def.ghi" {
+    t.Errorf("unexpected token, got %q", got)
+  }
+}
+
+func TestBuildTokenExtractorsLegacyCookieKey(t *testing.T) {
+  extractors, err := buildTokenExtractors(nil, "jwt")
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  req := &http.Request{Header: http.Header{"Cookie": []string{"jwt=cookie-token"}}}
+  var raw string
+  for _, extract := range extractors {
+    if raw = extract(req); raw != "" {
+      break
+    }
+  }
+  if raw != "cookie-token" {
+    t.Errorf("unexpected token, got %q", raw)
+  }
+}
+
+// TestBuildTokenExtractorsLegacyCookieKeyStillTriesBearerHeader guards against regressing the
+// pre-TokenLookup behaviour: a bare jwt_cookie_key config must still accept a Bearer header,
+// since that was always tried first before TokenLookup existed.
+func TestBuildTokenExtractorsLegacyCookieKeyStillTriesBearerHeader(t *testing.T) {
+  extractors, err := buildTokenExtractors(nil, "jwt")
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  req := &http.Request{Header: http.Header{"Authorization": []string{"Bearer abc.def.ghi"}}}
+  var raw string
+  for _, extract := range extractors {
+    if raw = extract(req); raw != "" {
+      break
+    }
+  }
+  if raw != "abc.def.ghi" {
+    t.Errorf("unexpected token, got %q", raw)
+  }
+}
+
+func TestBuildTokenExtractorsTriesEachSourceInOrder(t *testing.T) {
+  extractors, err := buildTokenExtractors([]string{"header:X-Access-Token", "query:access_token"}, "")
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  req := &http.Request{
+    Header: http.Header{},
+    URL:    &url.URL{RawQuery: "access_token=from-query"},
+  }
+  var raw string
+  for _, extract := range extractors {
+    if raw = extract(req); raw != "" {
+      break
+    }
+  }
+  if raw != "from-query" {
+    t.Errorf("unexpected token, got %q", raw)
+  }
+}
+
+func TestBuildTokenExtractorsFormReadsPostBodyOnly(t *testing.T) {
+  extractors, err := buildTokenExtractors([]string{"form:access_token"}, "")
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  req, err := http.NewRequest(http.MethodPost, "http://example.com/?access_token=leaked-via-query", strings.NewReader("access_token=from-form-body"))
+  if err != nil {
+    t.Fatalf("unexpected error building request: %v", err)
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  if got := extractors[0](req); got != "from-form-body" {
+    t.Errorf("unexpected token, got %q", got)
+  }
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    t.Fatalf("unexpected error reading restored body: %v", err)
+  }
+  if string(body) != "access_token=from-form-body" {
+    t.Errorf("form extractor must not consume req.Body, got %q", body)
+  }
+
+  getReq, err := http.NewRequest(http.MethodGet, "http://example.com/?access_token=leaked-via-query", nil)
+  if err != nil {
+    t.Fatalf("unexpected error building request: %v", err)
+  }
+  if got := extractors[0](getReq); got != "" {
+    t.Errorf("expected form extractor to ignore query string, got %q", got)
+  }
+}
+
+func TestParseTokenLookupInvalidEntry(t *testing.T) {
+  if _, err := parseTokenLookup("bogus"); err == nil {
+    t.Errorf("expected error for malformed entry, got nil")
+  }
+  if _, err := parseTokenLookup("carrier-pigeon:name"); err == nil {
+    t.Errorf("expected error for unknown source, got nil")
+  }
+}